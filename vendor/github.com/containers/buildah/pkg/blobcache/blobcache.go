@@ -2,18 +2,24 @@ package blobcache
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/containers/image/docker/reference"
 	"github.com/containers/image/image"
 	"github.com/containers/image/manifest"
+	"github.com/containers/image/pkg/blobinfocache"
 	"github.com/containers/image/transports"
 	"github.com/containers/image/transports/alltransports"
 	"github.com/containers/image/types"
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/ioutils"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -52,12 +58,56 @@ type BlobCache interface {
 	// ClearCache() clears the contents of the cache directories.  Note that this also clears
 	// content which was not placed there by this cache implementation.
 	ClearCache() error
+	// BlobInfoCache returns the persistent types.BlobInfoCache which backs this cache, so that it
+	// can be passed to copy.Image() via SystemContext to let compression-variant substitution work
+	// across processes which share this cache directory.
+	BlobInfoCache() types.BlobInfoCache
+	// Prune evicts least-recently-used files (blobs, configs and compression-variant sidecars,
+	// each ranked by its own access time) from the first cache directory until its total size is
+	// at most maxBytes, and separately evicts any entry untouched for longer than maxAge.  Evicting
+	// a file also removes the BlobInfoCache entries for its digest.  A blob and its sidecar are
+	// evicted separately: removing one does not remove the other.  A zero maxBytes or maxAge
+	// disables that half of the check.  It returns the number of bytes freed.
+	Prune(maxBytes int64, maxAge time.Duration) (int64, error)
+}
+
+// Options includes settings that change the behavior of the blob cache.
+type Options struct {
+	// Compress selects an additional compression variant of each layer blob that PutBlob should
+	// cache under its own digest, so that a later read which needs that variant can be served
+	// from the cache instead of re-fetching (or re-compressing) the whole layer.  The zero value,
+	// types.PreserveOriginal, leaves that choice to the wrapped destination's
+	// DesiredLayerCompression().
+	Compress types.LayerCompression
+	// MaxBytes, if not zero, bounds the total size of the blobs (not counting the persistent
+	// BlobInfoCache or access log) kept in the first cache directory.  After every PutBlob, the
+	// least-recently-used entries are evicted until the total drops back to MaxBytes.
+	MaxBytes int64
+	// MaxAge, if not zero, bounds how long an entry may sit in the cache without being written or
+	// read before PutBlob evicts it, regardless of MaxBytes.
+	MaxAge time.Duration
 }
 
 type blobCacheReference struct {
-	transport   *blobCacheTransport
-	reference   types.ImageReference
-	directories []string
+	transport     *blobCacheTransport
+	reference     types.ImageReference
+	directories   []string
+	blobInfoCache *blobinfocache.FileCache
+	options       Options
+	// blobLocks holds one *sync.Mutex per digest.Digest that PutBlob has been asked to write, so that
+	// concurrent copies which race to cache the same blob (for example, two pulls running with
+	// MaxParallelDownloads > 1 against the same cache directory) serialize on the tempfile-then-
+	// rename dance instead of corrupting each other's output.
+	blobLocks sync.Map
+}
+
+// lockFor returns the mutex that PutBlob should hold while writing blobDigest, creating one on
+// first use. The entry is intentionally never removed; the number of distinct digests a single
+// cache directory sees over its lifetime is bounded by the number of blobs it ever caches, which
+// is small enough that leaking one *sync.Mutex per digest isn't worth the complexity of cleanup.
+func (r *blobCacheReference) lockFor(blobDigest digest.Digest) *sync.Mutex {
+	value, _ := r.blobLocks.LoadOrStore(blobDigest, &sync.Mutex{})
+	return value.(*sync.Mutex)
 }
 
 type blobCacheSource struct {
@@ -65,6 +115,14 @@ type blobCacheSource struct {
 	source    types.ImageSource
 }
 
+// blobCacheDestination wraps a types.ImageDestination, caching and serving the blobs written
+// through it. It advertises HasThreadSafePutBlob honestly (see below), which is what lets
+// copy.Image with MaxParallelDownloads > 1 share a single cache directory safely; that's only a
+// partial answer to runcom/builder#chunk0-4, though, which also asked for blobCacheSource/
+// blobCacheDestination to adopt internal/private.ImageSource and internal/private.ImageDestination
+// so that TryReusingBlob and friends see through the cache like they do other destinations. That
+// half is not done and isn't doable against this copy of containers/image, which predates those
+// private interfaces.
 type blobCacheDestination struct {
 	reference   *blobCacheReference
 	destination types.ImageDestination
@@ -77,6 +135,76 @@ func makeFilename(blobSum digest.Digest, isConfig bool) string {
 	return blobSum.String()
 }
 
+// blobInfoCacheFilename is the name, within the first cache directory, of the persistent
+// types.BlobInfoCache that backs BlobInfoCache().
+const blobInfoCacheFilename = "blobinfocache.json"
+
+// cacheSuffixes lists every on-disk suffix a blob's digest might be stored under: the blob itself,
+// an image config, and the alternate-compression sidecars that PutBlob writes when it's asked to
+// also cache the opposite compression variant of a layer.
+var cacheSuffixes = []string{"", ".config", ".uncompressed", ".gzip"}
+
+// uncompressedSidecarFilename is the name, within a cache directory, under which PutBlob stores an
+// uncompressed copy of a layer blob that was written to it in compressed form.
+func uncompressedSidecarFilename(uncompressedDigest digest.Digest) string {
+	return uncompressedDigest.String() + ".uncompressed"
+}
+
+// gzipSidecarFilename is the name, within a cache directory, under which PutBlob stores a
+// gzip-compressed copy of a layer blob that was written to it in uncompressed form.
+func gzipSidecarFilename(compressedDigest digest.Digest) string {
+	return compressedDigest.String() + ".gzip"
+}
+
+// accessLogFilename is the name, within the first cache directory, of the sidecar log of access
+// times that Prune consults instead of relying on the filesystem's atime, since cache directories
+// are routinely mounted noatime.
+const accessLogFilename = ".access"
+
+// accessLogMutex serializes the read-modify-write of the access-time sidecar across all
+// directories. The per-digest locks handed out by blobCacheReference.lockFor only keep two writers
+// of the *same* digest from stepping on each other; touch and Prune both read the whole sidecar,
+// mutate one entry (or several, for Prune), and rewrite it, so two writes of *different* digests
+// need this to keep from losing one of the updates.
+var accessLogMutex sync.Mutex
+
+// readAccessLog reads the access-time sidecar for directory, tolerating it being absent.
+func readAccessLog(directory string) (map[string]time.Time, error) {
+	times := map[string]time.Time{}
+	contents, err := ioutil.ReadFile(filepath.Join(directory, accessLogFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return times, nil
+		}
+		return nil, errors.Wrapf(err, "error reading access log in %q", directory)
+	}
+	if err := json.Unmarshal(contents, &times); err != nil {
+		return nil, errors.Wrapf(err, "error parsing access log in %q", directory)
+	}
+	return times, nil
+}
+
+// touch records that name (a file directly under directory) was just created or read, for the
+// benefit of a later Prune.
+func touch(directory, name string) {
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	times, err := readAccessLog(directory)
+	if err != nil {
+		logrus.Debugf("error reading access log in %q: %v", directory, err)
+		times = map[string]time.Time{}
+	}
+	times[name] = time.Now()
+	contents, err := json.Marshal(times)
+	if err != nil {
+		logrus.Debugf("error encoding access log for %q: %v", directory, err)
+		return
+	}
+	if err = ioutils.AtomicWriteFile(filepath.Join(directory, accessLogFilename), contents, 0600); err != nil {
+		logrus.Debugf("error writing access log for %q: %v", directory, err)
+	}
+}
+
 func (t *blobCacheTransport) Name() string {
 	return "blob-cache"
 }
@@ -99,7 +227,7 @@ func (t *blobCacheTransport) ParseReference(reference string) (types.ImageRefere
 	if err != nil {
 		return nil, errors.Wrapf(err, "error parsing reference %q", realRef)
 	}
-	return NewBlobCache(ref, directories)
+	return NewBlobCache(ref, directories, Options{})
 }
 
 func (t *blobCacheTransport) ValidatePolicyConfigurationScope(scope string) error {
@@ -110,14 +238,34 @@ func (t *blobCacheTransport) ValidatePolicyConfigurationScope(scope string) erro
 // written to the destination image created from the resulting reference will also be stored
 // as-is to the specifed directory or a temporary directory.  The cache directory's contents
 // can be cleared by calling the returned BlobCache()'s ClearCache() method.
-func NewBlobCache(ref types.ImageReference, directories []string) (BlobCache, error) {
+//
+// It also maintains a persistent types.BlobInfoCache in the first cache directory, recording
+// which digests are known to be present at the wrapped destination.  Callers that want that
+// knowledge to inform copy.Image's own blob reuse logic (for example, to avoid re-uploading a
+// blob whose gzip-compressed variant is already known to be present under a different digest)
+// should fetch it with BlobInfoCache() and set it as the BlobInfoCache of the SystemContext they
+// pass to copy.Image.
+//
+// If options.Compress is Compress or Decompress, PutBlob also caches the opposite compression
+// variant of each layer blob it writes, under its own digest, so that a later read of either
+// digest can be served from the cache.
+//
+// If options.MaxBytes or options.MaxAge is set, PutBlob opportunistically calls Prune with those
+// limits after every write, so that the cache directory doesn't grow without bound.
+func NewBlobCache(ref types.ImageReference, directories []string, options Options) (BlobCache, error) {
 	if len(directories) == 0 {
 		return nil, errors.Errorf("error building cache: no cache directory specified for %q", transports.ImageName(ref))
 	}
+	infoCache, err := blobinfocache.NewFileCache(filepath.Join(directories[0], blobInfoCacheFilename))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating blob info cache in %q", directories[0])
+	}
 	return &blobCacheReference{
-		transport:   Transport,
-		reference:   ref,
-		directories: append([]string{}, directories...),
+		transport:     Transport,
+		reference:     ref,
+		directories:   append([]string{}, directories...),
+		blobInfoCache: infoCache,
+		options:       options,
 	}, nil
 }
 
@@ -151,8 +299,8 @@ func (r *blobCacheReference) HasBlob(blobinfo types.BlobInfo) (bool, int64, erro
 	}
 
 	for _, directory := range r.directories {
-		for _, isConfig := range []bool{false, true} {
-			filename := filepath.Join(directory, makeFilename(blobinfo.Digest, isConfig))
+		for _, suffix := range cacheSuffixes {
+			filename := filepath.Join(directory, blobinfo.Digest.String()+suffix)
 			fileInfo, err := os.Stat(filename)
 			if err == nil && (blobinfo.Size == -1 || blobinfo.Size == fileInfo.Size()) {
 				return true, fileInfo.Size(), nil
@@ -170,6 +318,17 @@ func (r *blobCacheReference) Directories() []string {
 	return append([]string{}, r.directories...)
 }
 
+func (r *blobCacheReference) BlobInfoCache() types.BlobInfoCache {
+	return r.blobInfoCache
+}
+
+// bicScope identifies the destination that a cached blob was seen at, for the purposes of the
+// persistent BlobInfoCache: blobs recorded against one destination shouldn't be offered as
+// substitutes for another.
+func bicScope(ref types.ImageReference) types.BICTransportScope {
+	return types.BICTransportScope{Opaque: ref.PolicyConfigurationIdentity()}
+}
+
 func (r *blobCacheReference) ClearCache() error {
 	for _, directory := range r.directories {
 		// Clear the directory's contents.
@@ -192,6 +351,100 @@ func (r *blobCacheReference) ClearCache() error {
 	return nil
 }
 
+// prunableEntry describes one file in a cache directory that Prune considers for eviction.
+type prunableEntry struct {
+	name   string
+	size   int64
+	atime  time.Time
+	digest digest.Digest
+}
+
+func (r *blobCacheReference) Prune(maxBytes int64, maxAge time.Duration) (int64, error) {
+	if len(r.directories) == 0 {
+		return 0, nil
+	}
+	directory := r.directories[0]
+	dirEntries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading cache directory %q", directory)
+	}
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	times, err := readAccessLog(directory)
+	if err != nil {
+		return 0, err
+	}
+
+	skip := map[string]bool{blobInfoCacheFilename: true, accessLogFilename: true}
+	var entries []prunableEntry
+	var total int64
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || skip[dirEntry.Name()] {
+			continue
+		}
+		base := dirEntry.Name()
+		for _, suffix := range cacheSuffixes {
+			if suffix != "" {
+				base = strings.TrimSuffix(base, suffix)
+			}
+		}
+		blobDigest, err := digest.Parse(base)
+		if err != nil {
+			continue // not one of ours; leave it alone
+		}
+		atime, ok := times[dirEntry.Name()]
+		if !ok {
+			atime = dirEntry.ModTime()
+		}
+		entries = append(entries, prunableEntry{name: dirEntry.Name(), size: dirEntry.Size(), atime: atime, digest: blobDigest})
+		total += dirEntry.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].atime.Before(entries[j].atime) })
+
+	var freed int64
+	now := time.Now()
+	evict := func(entry prunableEntry) {
+		if err := os.Remove(filepath.Join(directory, entry.name)); err != nil {
+			if !os.IsNotExist(err) {
+				logrus.Debugf("error removing %q while pruning cache %q: %v", entry.name, directory, err)
+			}
+			return
+		}
+		freed += entry.size
+		total -= entry.size
+		delete(times, entry.name)
+		if r.blobInfoCache != nil {
+			r.blobInfoCache.Forget(entry.digest)
+		}
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if maxAge != 0 && now.Sub(entry.atime) > maxAge {
+			evict(entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if maxBytes != 0 {
+		for _, entry := range kept {
+			if total <= maxBytes {
+				break
+			}
+			evict(entry)
+		}
+	}
+
+	if contents, err := json.Marshal(times); err == nil {
+		if err := ioutils.AtomicWriteFile(filepath.Join(directory, accessLogFilename), contents, 0600); err != nil {
+			logrus.Debugf("error rewriting access log for %q: %v", directory, err)
+		}
+	}
+
+	return freed, nil
+}
+
 func (r *blobCacheReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
 	src, err := r.NewImageSource(ctx, sys)
 	if err != nil {
@@ -247,14 +500,15 @@ func (s *blobCacheSource) GetBlob(ctx context.Context, blobinfo types.BlobInfo)
 	}
 	if present {
 		for _, directory := range s.reference.directories {
-			for _, isConfig := range []bool{false, true} {
-				filename := filepath.Join(directory, makeFilename(blobinfo.Digest, isConfig))
+			for _, suffix := range cacheSuffixes {
+				filename := filepath.Join(directory, blobinfo.Digest.String()+suffix)
 				f, err := os.Open(filename)
 				if err == nil {
+					touch(directory, blobinfo.Digest.String()+suffix)
 					return f, size, nil
 				}
 				if !os.IsNotExist(err) {
-					return nil, -1, errors.Wrapf(err, "error checking for cache file %q", filepath.Join(directory, filename))
+					return nil, -1, errors.Wrapf(err, "error checking for cache file %q", filename)
 				}
 			}
 		}
@@ -274,6 +528,16 @@ func (s *blobCacheSource) LayerInfosForCopy(ctx context.Context) ([]types.BlobIn
 	return nil, nil
 }
 
+// HasThreadSafeGetBlob indicates that it's safe for copy.Image to call GetBlob for several blobs
+// of the same image concurrently. GetBlob does write to the cache directory, via touch() on every
+// cache hit, but that stays race-free because touch holds accessLogMutex for the whole
+// read-modify-write of the access log; the cost is that concurrent GetBlob hits serialize on that
+// mutex rather than running in parallel, partly undercutting the safe-for-concurrency advertised
+// here.
+func (s *blobCacheSource) HasThreadSafeGetBlob() bool {
+	return true
+}
+
 func (d *blobCacheDestination) Reference() types.ImageReference {
 	return d.reference
 }
@@ -306,10 +570,22 @@ func (d *blobCacheDestination) IgnoresEmbeddedDockerReference() bool {
 	return d.destination.IgnoresEmbeddedDockerReference()
 }
 
+// HasThreadSafePutBlob indicates that it's safe for copy.Image to call PutBlob for several blobs
+// of the same image concurrently. PutBlob takes reference.lockFor(inputInfo.Digest) before
+// touching the cache directory, so concurrent writes of the same digest serialize instead of
+// racing on the shared tempfile-then-rename dance; writes of distinct digests contend only on
+// accessLogMutex, while touch (and Prune, when limits are set) update the access log.
+func (d *blobCacheDestination) HasThreadSafePutBlob() bool {
+	return true
+}
+
 func (d *blobCacheDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, isConfig bool) (types.BlobInfo, error) {
 	var tempfile *os.File
 	var err error
 	if inputInfo.Digest != "" {
+		mutex := d.reference.lockFor(inputInfo.Digest)
+		mutex.Lock()
+		defer mutex.Unlock()
 		directory := d.reference.directories[0]
 		if directory == "" {
 			directory = "."
@@ -322,6 +598,16 @@ func (d *blobCacheDestination) PutBlob(ctx context.Context, stream io.Reader, in
 				if err == nil {
 					if err = os.Rename(tempfile.Name(), filename); err != nil {
 						err = errors.Wrapf(err, "error renaming new layer for blob %q into place at %q", inputInfo.Digest.String(), filename)
+					} else {
+						touch(directory, filepath.Base(filename))
+						if !isConfig {
+							d.cacheCompressionVariant(directory, filename, inputInfo.Digest)
+						}
+						if d.reference.options.MaxBytes != 0 || d.reference.options.MaxAge != 0 {
+							if _, err := d.reference.Prune(d.reference.options.MaxBytes, d.reference.options.MaxAge); err != nil {
+								logrus.Debugf("error pruning cache %q after write: %v", directory, err)
+							}
+						}
 					}
 				} else {
 					if err2 := os.Remove(tempfile.Name()); err2 != nil {
@@ -338,9 +624,119 @@ func (d *blobCacheDestination) PutBlob(ctx context.Context, stream io.Reader, in
 	if err != nil {
 		return newBlobInfo, errors.Wrapf(err, "error storing blob to image destination for cache %q", transports.ImageName(d.reference))
 	}
+	if d.reference.blobInfoCache != nil {
+		d.reference.blobInfoCache.RecordKnownLocation(d.destination.Reference().Transport(), bicScope(d.destination.Reference()), newBlobInfo.Digest, types.BICLocationReference{Opaque: newBlobInfo.Digest.String()})
+	}
 	return newBlobInfo, nil
 }
 
+// cacheCompressionVariant looks at the blob that was just cached at filename under digest
+// blobDigest and, if options.Compress (or, when that is types.PreserveOriginal, the wrapped
+// destination's DesiredLayerCompression()) asks for the opposite of what's there, writes a sidecar
+// copy in that compression and records the compressed<->uncompressed digest pair in the persistent
+// BlobInfoCache.  This lets a later copy which presents either digest be served from this cache
+// directory without re-fetching the layer.
+func (d *blobCacheDestination) cacheCompressionVariant(directory, filename string, blobDigest digest.Digest) {
+	desired := d.reference.options.Compress
+	if desired == types.PreserveOriginal {
+		desired = d.destination.DesiredLayerCompression()
+	}
+	if desired != types.Compress && desired != types.Decompress {
+		return
+	}
+	// archive.DetectCompression only needs to see the start of the file, and works off of a
+	// []byte rather than an io.Reader, so peek at the header instead of handing it the whole file.
+	header := make([]byte, 512)
+	f, err := os.Open(filename)
+	if err != nil {
+		logrus.Debugf("error opening cached blob %q to check its compression: %v", filename, err)
+		return
+	}
+	n, err := f.Read(header)
+	f.Close()
+	if err != nil && err != io.EOF {
+		logrus.Debugf("error reading cached blob %q to check its compression: %v", filename, err)
+		return
+	}
+	compression := archive.DetectCompression(header[:n])
+
+	switch {
+	case desired == types.Decompress && compression != archive.Uncompressed:
+		compressed, err := os.Open(filename)
+		if err != nil {
+			logrus.Debugf("error opening cached blob %q to decompress: %v", filename, err)
+			return
+		}
+		defer compressed.Close()
+		uncompressed, err := archive.DecompressStream(compressed)
+		if err != nil {
+			logrus.Debugf("error decompressing cached blob %q: %v", filename, err)
+			return
+		}
+		defer uncompressed.Close()
+		digester := digest.Canonical.Digester()
+		sidecar, err := ioutil.TempFile(directory, "sidecar")
+		if err != nil {
+			logrus.Debugf("error creating temporary file to hold decompressed copy of %q: %v", filename, err)
+			return
+		}
+		if _, err = io.Copy(io.MultiWriter(sidecar, digester.Hash()), uncompressed); err != nil {
+			sidecar.Close()
+			os.Remove(sidecar.Name())
+			logrus.Debugf("error decompressing cached blob %q: %v", filename, err)
+			return
+		}
+		sidecar.Close()
+		uncompressedDigest := digester.Digest()
+		sidecarName := filepath.Join(directory, uncompressedSidecarFilename(uncompressedDigest))
+		if err = os.Rename(sidecar.Name(), sidecarName); err != nil {
+			logrus.Debugf("error renaming decompressed copy of %q into place at %q: %v", filename, sidecarName, err)
+			return
+		}
+		if d.reference.blobInfoCache != nil {
+			d.reference.blobInfoCache.RecordDigestUncompressedPair(blobDigest, uncompressedDigest)
+		}
+	case desired == types.Compress && compression == archive.Uncompressed:
+		uncompressed, err := os.Open(filename)
+		if err != nil {
+			logrus.Debugf("error opening cached blob %q to compress: %v", filename, err)
+			return
+		}
+		defer uncompressed.Close()
+		sidecar, err := ioutil.TempFile(directory, "sidecar")
+		if err != nil {
+			logrus.Debugf("error creating temporary file to hold compressed copy of %q: %v", filename, err)
+			return
+		}
+		digester := digest.Canonical.Digester()
+		writer, err := archive.CompressStream(io.MultiWriter(sidecar, digester.Hash()), archive.Gzip)
+		if err != nil {
+			sidecar.Close()
+			os.Remove(sidecar.Name())
+			logrus.Debugf("error setting up gzip compression for %q: %v", filename, err)
+			return
+		}
+		if _, err = io.Copy(writer, uncompressed); err != nil {
+			writer.Close()
+			sidecar.Close()
+			os.Remove(sidecar.Name())
+			logrus.Debugf("error compressing cached blob %q: %v", filename, err)
+			return
+		}
+		writer.Close()
+		sidecar.Close()
+		compressedDigest := digester.Digest()
+		sidecarName := filepath.Join(directory, gzipSidecarFilename(compressedDigest))
+		if err = os.Rename(sidecar.Name(), sidecarName); err != nil {
+			logrus.Debugf("error renaming compressed copy of %q into place at %q: %v", filename, sidecarName, err)
+			return
+		}
+		if d.reference.blobInfoCache != nil {
+			d.reference.blobInfoCache.RecordDigestUncompressedPair(compressedDigest, blobDigest)
+		}
+	}
+}
+
 func (d *blobCacheDestination) HasBlob(ctx context.Context, info types.BlobInfo) (bool, int64, error) {
 	present, size, err := d.reference.HasBlob(info)
 	if err != nil {
@@ -349,6 +745,14 @@ func (d *blobCacheDestination) HasBlob(ctx context.Context, info types.BlobInfo)
 	if present {
 		return present, size, nil
 	}
+	if d.reference.blobInfoCache != nil {
+		candidates := d.reference.blobInfoCache.CandidateLocations(d.destination.Reference().Transport(), bicScope(d.destination.Reference()), info.Digest, true)
+		for _, candidate := range candidates {
+			if present, size, err := d.reference.HasBlob(types.BlobInfo{Digest: candidate.Digest, Size: -1}); err == nil && present {
+				return true, size, nil
+			}
+		}
+	}
 	return d.destination.HasBlob(ctx, info)
 }
 
@@ -368,6 +772,20 @@ func (d *blobCacheDestination) ReapplyBlob(ctx context.Context, info types.BlobI
 				}
 			}
 		}
+		if d.reference.blobInfoCache != nil {
+			for _, candidate := range d.reference.blobInfoCache.CandidateLocations(d.destination.Reference().Transport(), bicScope(d.destination.Reference()), info.Digest, true) {
+				for _, directory := range d.reference.directories {
+					for _, suffix := range cacheSuffixes {
+						filename := filepath.Join(directory, candidate.Digest.String()+suffix)
+						f, err := os.Open(filename)
+						if err == nil {
+							defer f.Close()
+							return d.destination.PutBlob(ctx, f, info, false)
+						}
+					}
+				}
+			}
+		}
 	}
 	return d.destination.ReapplyBlob(ctx, info)
 }
@@ -394,3 +812,19 @@ func (d *blobCacheDestination) PutSignatures(ctx context.Context, signatures [][
 func (d *blobCacheDestination) Commit(ctx context.Context) error {
 	return d.destination.Commit(ctx)
 }
+
+// STATUS(runcom/builder#chunk0-5): NOT IMPLEMENTED, and not closeable from this tree. zstd:chunked
+// partial-pull caching (PutBlobPartial on blobCacheDestination, GetBlobAt on blobCacheSource, and a
+// layer-digest-to-chunk-digests map in the BlobInfoCache) is still an open request, left open here
+// rather than marked done, because it's blocked on dependencies this vendored tree doesn't have at
+// all: zstd:chunked layers are fetched a byte range at a time through internal/private.ImageSource's
+// GetBlobAt, and a destination opts in to receiving those same byte ranges via
+// internal/private.ImageDestination's PutBlobPartial instead of a single PutBlob stream, and making
+// sense of the chunk boundaries in the first place needs pkg/chunked and tar-split support. This
+// copy of containers/image predates all of that, so every blob blobCacheDestination caches still
+// arrives, and is served back, as a single whole stream through PutBlob and GetBlob above; there is
+// no synthetic zstd:chunked test here because there is nothing to test. Re-open and implement this
+// once a newer containers/image is vendored. If/when that happens, the per-digest locking in PutBlob
+// and the persistent BlobInfoCache added above are the two pieces a chunk-aware cache would build
+// on: the lock would become per-chunk, and the BlobInfoCache would gain a
+// layer-digest-to-chunk-digests mapping alongside the compression-variant pairs it already tracks.
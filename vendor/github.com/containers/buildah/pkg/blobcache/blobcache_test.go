@@ -10,7 +10,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	cp "github.com/containers/image/copy"
 	"github.com/containers/image/signature"
@@ -228,3 +230,260 @@ func TestBlobCache(t *testing.T) {
 		}
 	}
 }
+
+// TestBlobCachePersistentInfoCache verifies that the BlobInfoCache() backing a cache directory
+// survives being reopened, and that it reports a compressed blob's digest as a substitute for its
+// own once the two have been recorded as sharing the same uncompressed digest, the way
+// blobCacheDestination.PutBlob records them when it writes a blob.
+func TestBlobCachePersistentInfoCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating cache directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	destdir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating destination directory: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	destRef, err := alltransports.ParseImageName("dir:" + destdir)
+	if err != nil {
+		t.Fatalf("error parsing destination image name: %v", err)
+	}
+
+	cacheRef, err := NewBlobCache(destRef, []string{cacheDir}, Options{})
+	if err != nil {
+		t.Fatalf("error creating blob cache: %v", err)
+	}
+
+	uncompressedDigest := digest.FromString("uncompressed content")
+	gzipDigest := digest.FromString("gzip-compressed content")
+	cacheRef.BlobInfoCache().RecordDigestUncompressedPair(gzipDigest, uncompressedDigest)
+	cacheRef.BlobInfoCache().RecordKnownLocation(destRef.Transport(), types.BICTransportScope{Opaque: destRef.PolicyConfigurationIdentity()}, gzipDigest, types.BICLocationReference{Opaque: gzipDigest.String()})
+
+	// Reopening the same cache directory should find the pair and location that were recorded above.
+	reopenedRef, err := NewBlobCache(destRef, []string{cacheDir}, Options{})
+	if err != nil {
+		t.Fatalf("error reopening blob cache: %v", err)
+	}
+	if got := reopenedRef.BlobInfoCache().UncompressedDigest(gzipDigest); got != uncompressedDigest {
+		t.Fatalf("expected uncompressed digest %q, got %q", uncompressedDigest, got)
+	}
+	candidates := reopenedRef.BlobInfoCache().CandidateLocations(destRef.Transport(), types.BICTransportScope{Opaque: destRef.PolicyConfigurationIdentity()}, uncompressedDigest, true)
+	found := false
+	for _, candidate := range candidates {
+		if candidate.Digest == gzipDigest {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected %q to be offered as a substitute for %q, candidates were %#v", gzipDigest, uncompressedDigest, candidates)
+	}
+}
+
+// fakeDestination wraps a types.ImageDestination and overrides DesiredLayerCompression, so that
+// tests can drive blobCacheDestination's compression-variant caching without a real destination
+// that wants a specific compression.
+type fakeDestination struct {
+	types.ImageDestination
+	compression types.LayerCompression
+}
+
+func (f *fakeDestination) DesiredLayerCompression() types.LayerCompression {
+	return f.compression
+}
+
+// TestBlobCacheCachesCompressionVariant verifies that writing an uncompressed layer to a
+// destination that wants Compress also leaves a gzip-compressed sidecar in the cache directory,
+// with the compressed<->uncompressed digest pair recorded in the persistent BlobInfoCache.
+func TestBlobCacheCachesCompressionVariant(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating cache directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	destdir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating destination directory: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	destRef, err := alltransports.ParseImageName("dir:" + destdir)
+	if err != nil {
+		t.Fatalf("error parsing destination image name: %v", err)
+	}
+	cacheRef, err := NewBlobCache(destRef, []string{cacheDir}, Options{Compress: types.Compress})
+	if err != nil {
+		t.Fatalf("error creating blob cache: %v", err)
+	}
+	destImage, err := cacheRef.NewImageDestination(context.TODO(), nil)
+	if err != nil {
+		t.Fatalf("error opening destination image for writing: %v", err)
+	}
+	bcd, ok := destImage.(*blobCacheDestination)
+	if !ok {
+		t.Fatalf("got something else back from NewImageDestination: %T", destImage)
+	}
+	bcd.destination = &fakeDestination{ImageDestination: bcd.destination, compression: types.Compress}
+
+	content := []byte("hello world, this is some uncompressed layer content")
+	blobInfo := types.BlobInfo{Digest: digest.FromBytes(content), Size: int64(len(content))}
+	if _, err = destImage.PutBlob(context.TODO(), bytes.NewReader(content), blobInfo, false); err != nil {
+		t.Fatalf("error writing layer blob: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("error reading cache directory %q: %v", cacheDir, err)
+	}
+	var compressedDigest digest.Digest
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".gzip") {
+			compressedDigest = digest.Digest(strings.TrimSuffix(entry.Name(), ".gzip"))
+		}
+	}
+	if compressedDigest == "" {
+		t.Fatalf("expected a .gzip sidecar in %q, got %v", cacheDir, entries)
+	}
+	if got := cacheRef.BlobInfoCache().UncompressedDigest(compressedDigest); got != blobInfo.Digest {
+		t.Fatalf("expected %q to be recorded as the uncompressed digest for %q, got %q", blobInfo.Digest, compressedDigest, got)
+	}
+
+	sidecar, err := os.Open(filepath.Join(cacheDir, gzipSidecarFilename(compressedDigest)))
+	if err != nil {
+		t.Fatalf("error opening gzip sidecar: %v", err)
+	}
+	defer sidecar.Close()
+	decompressed, err := archive.DecompressStream(sidecar)
+	if err != nil {
+		t.Fatalf("error decompressing gzip sidecar: %v", err)
+	}
+	defer decompressed.Close()
+	roundTripped, err := ioutil.ReadAll(decompressed)
+	if err != nil {
+		t.Fatalf("error reading decompressed sidecar: %v", err)
+	}
+	if !bytes.Equal(roundTripped, content) {
+		t.Fatalf("expected decompressed sidecar content %q, got %q", content, roundTripped)
+	}
+}
+
+// TestBlobCachePruneByMaxBytes verifies that once a cache with a MaxBytes limit grows past it,
+// PutBlob evicts the least-recently-written blobs (and their BlobInfoCache records) to make room,
+// while leaving the most recently written blob in place.
+func TestBlobCachePruneByMaxBytes(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating cache directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	destdir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating destination directory: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	destRef, err := alltransports.ParseImageName("dir:" + destdir)
+	if err != nil {
+		t.Fatalf("error parsing destination image name: %v", err)
+	}
+
+	blobs := [][]byte{
+		[]byte("oldest blob content, first in"),
+		[]byte("middle blob content, second"),
+		[]byte("newest blob content, third in"),
+	}
+	var maxBytes int64
+	for _, b := range blobs[1:] {
+		maxBytes += int64(len(b))
+	}
+	cacheRef, err := NewBlobCache(destRef, []string{cacheDir}, Options{MaxBytes: maxBytes})
+	if err != nil {
+		t.Fatalf("error creating blob cache: %v", err)
+	}
+	destImage, err := cacheRef.NewImageDestination(context.TODO(), nil)
+	if err != nil {
+		t.Fatalf("error opening destination image for writing: %v", err)
+	}
+
+	var digests []digest.Digest
+	for _, b := range blobs {
+		blobInfo := types.BlobInfo{Digest: digest.FromBytes(b), Size: int64(len(b))}
+		digests = append(digests, blobInfo.Digest)
+		if _, err = destImage.PutBlob(context.TODO(), bytes.NewReader(b), blobInfo, false); err != nil {
+			t.Fatalf("error writing layer blob: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if present, _, err := cacheRef.HasBlob(types.BlobInfo{Digest: digests[0], Size: -1}); err != nil || present {
+		t.Fatalf("expected the oldest blob %q to have been pruned, present=%v err=%v", digests[0], present, err)
+	}
+	if present, _, err := cacheRef.HasBlob(types.BlobInfo{Digest: digests[len(digests)-1], Size: -1}); err != nil || !present {
+		t.Fatalf("expected the newest blob %q to still be cached, present=%v err=%v", digests[len(digests)-1], present, err)
+	}
+	candidates := cacheRef.BlobInfoCache().CandidateLocations(destRef.Transport(), types.BICTransportScope{Opaque: destRef.PolicyConfigurationIdentity()}, digests[0], false)
+	if len(candidates) != 0 {
+		t.Fatalf("expected no known location for pruned blob %q, got %#v", digests[0], candidates)
+	}
+}
+
+func TestBlobCachePutBlobConcurrently(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating cache directory: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	destdir, err := ioutil.TempDir("", "blobcache")
+	if err != nil {
+		t.Fatalf("error creating destination directory: %v", err)
+	}
+	defer os.RemoveAll(destdir)
+
+	destRef, err := alltransports.ParseImageName("dir:" + destdir)
+	if err != nil {
+		t.Fatalf("error parsing destination image name: %v", err)
+	}
+	cacheRef, err := NewBlobCache(destRef, []string{cacheDir}, Options{})
+	if err != nil {
+		t.Fatalf("error creating blob cache: %v", err)
+	}
+	destImage, err := cacheRef.NewImageDestination(context.TODO(), nil)
+	if err != nil {
+		t.Fatalf("error opening destination image for writing: %v", err)
+	}
+	if !destImage.HasThreadSafePutBlob() {
+		t.Fatalf("expected the cache destination to advertise HasThreadSafePutBlob")
+	}
+	srcImage, err := cacheRef.NewImageSource(context.TODO(), nil)
+	if err != nil {
+		t.Fatalf("error opening source image for reading: %v", err)
+	}
+	if !srcImage.HasThreadSafeGetBlob() {
+		t.Fatalf("expected the cache source to advertise HasThreadSafeGetBlob")
+	}
+
+	const nblobs = 8
+	var wg sync.WaitGroup
+	errs := make([]error, nblobs)
+	for i := 0; i < nblobs; i++ {
+		b := []byte(fmt.Sprintf("concurrent blob content %d", i))
+		wg.Add(1)
+		go func(i int, b []byte) {
+			defer wg.Done()
+			blobInfo := types.BlobInfo{Digest: digest.FromBytes(b), Size: int64(len(b))}
+			_, errs[i] = destImage.PutBlob(context.TODO(), bytes.NewReader(b), blobInfo, false)
+		}(i, b)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("error writing blob %d concurrently: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package blobinfocache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/containers/image/types"
+	"github.com/containers/storage/pkg/ioutils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// fileCacheData is the JSON-serializable content of a FileCache.
+type fileCacheData struct {
+	// UncompressedDigests maps any digest to the digest of the uncompressed version of the same blob.
+	// It is allowed for a digest to map to itself.
+	UncompressedDigests map[digest.Digest]digest.Digest `json:"uncompressedDigests"`
+	// KnownLocations maps a transport name and a scope within that transport to the set of digests
+	// known to be present there, recording the most recently recorded location reference for each.
+	KnownLocations map[string]map[string]map[digest.Digest]string `json:"knownLocations"`
+}
+
+// FileCache is a file-backed implementation of types.BlobInfoCache.
+//
+// Unlike NoCache, which records nothing, a FileCache survives across processes, so that a second
+// copy which reuses the same cache directory (for example, the directory backing a
+// github.com/containers/buildah/pkg/blobcache BlobCache) can still find blobs that an earlier
+// process already recorded. It is not safe for use by multiple processes at once. Its mutex only
+// serializes calls made through the same FileCache; two FileCaches opened on the same path (as
+// happens when NewBlobCache is called twice for one directory) do not lock against each other.
+type FileCache struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileCache returns a BlobInfoCache implementation which keeps its state in the JSON file at path,
+// creating it on first use. path is typically a file inside a longer-lived cache directory.
+//
+// The concrete *FileCache type is returned, rather than the types.BlobInfoCache interface, so that
+// callers which also need to prune entries (see Forget) don't have to type-assert their way there.
+func NewFileCache(path string) (*FileCache, error) {
+	return &FileCache{path: path}, nil
+}
+
+func (fc *FileCache) load() (*fileCacheData, error) {
+	data := &fileCacheData{
+		UncompressedDigests: map[digest.Digest]digest.Digest{},
+		KnownLocations:      map[string]map[string]map[digest.Digest]string{},
+	}
+	contents, err := ioutil.ReadFile(fc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return data, nil
+		}
+		return nil, errors.Wrapf(err, "error reading blob info cache %q", fc.path)
+	}
+	if err := json.Unmarshal(contents, data); err != nil {
+		return nil, errors.Wrapf(err, "error parsing blob info cache %q", fc.path)
+	}
+	if data.UncompressedDigests == nil {
+		data.UncompressedDigests = map[digest.Digest]digest.Digest{}
+	}
+	if data.KnownLocations == nil {
+		data.KnownLocations = map[string]map[string]map[digest.Digest]string{}
+	}
+	return data, nil
+}
+
+func (fc *FileCache) save(data *fileCacheData) error {
+	contents, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding blob info cache")
+	}
+	if err := ioutils.AtomicWriteFile(fc.path, contents, 0600); err != nil {
+		return errors.Wrapf(err, "error writing blob info cache %q", fc.path)
+	}
+	return nil
+}
+
+func (fc *FileCache) UncompressedDigest(anyDigest digest.Digest) digest.Digest {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	data, err := fc.load()
+	if err != nil {
+		return ""
+	}
+	return data.UncompressedDigests[anyDigest]
+}
+
+func (fc *FileCache) RecordDigestUncompressedPair(anyDigest digest.Digest, uncompressed digest.Digest) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	data, err := fc.load()
+	if err != nil {
+		return
+	}
+	// It's possible for anyDigest to already be mapped to a different uncompressed digest (e.g. for
+	// encrypted data); the caller is expected to treat RecordDigestUncompressedPair as idempotent, so
+	// just keep the most recently recorded value.
+	data.UncompressedDigests[anyDigest] = uncompressed
+	_ = fc.save(data)
+}
+
+func (fc *FileCache) RecordKnownLocation(transport types.ImageTransport, scope types.BICTransportScope, blobDigest digest.Digest, location types.BICLocationReference) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	data, err := fc.load()
+	if err != nil {
+		return
+	}
+	byScope, ok := data.KnownLocations[transport.Name()]
+	if !ok {
+		byScope = map[string]map[digest.Digest]string{}
+		data.KnownLocations[transport.Name()] = byScope
+	}
+	byDigest, ok := byScope[scope.Opaque]
+	if !ok {
+		byDigest = map[digest.Digest]string{}
+		byScope[scope.Opaque] = byDigest
+	}
+	byDigest[blobDigest] = location.Opaque
+	_ = fc.save(data)
+}
+
+func (fc *FileCache) CandidateLocations(transport types.ImageTransport, scope types.BICTransportScope, primaryDigest digest.Digest, canSubstitute bool) []types.BICReplacementCandidate {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	data, err := fc.load()
+	if err != nil {
+		return nil
+	}
+	byScope := data.KnownLocations[transport.Name()]
+	if byScope == nil {
+		return nil
+	}
+	byDigest := byScope[scope.Opaque]
+	if byDigest == nil {
+		return nil
+	}
+
+	digests := []digest.Digest{primaryDigest}
+	if canSubstitute {
+		if uncompressed, ok := data.UncompressedDigests[primaryDigest]; ok {
+			for d, u := range data.UncompressedDigests {
+				if u == uncompressed && d != primaryDigest {
+					digests = append(digests, d)
+				}
+			}
+		} else {
+			// primaryDigest might itself be an uncompressed digest; look for compressed blobs that match it.
+			for d, u := range data.UncompressedDigests {
+				if u == primaryDigest && d != primaryDigest {
+					digests = append(digests, d)
+				}
+			}
+		}
+	}
+
+	var candidates []types.BICReplacementCandidate
+	for _, d := range digests {
+		if opaque, ok := byDigest[d]; ok {
+			candidates = append(candidates, types.BICReplacementCandidate{
+				Digest:   d,
+				Location: types.BICLocationReference{Opaque: opaque},
+			})
+		}
+	}
+	return candidates
+}
+
+// Forget removes every record of blobDigest: its uncompressed-digest pairing in either direction,
+// and every known location recorded for it under any transport or scope. It is not part of
+// types.BlobInfoCache, since most implementations have no reason to ever evict anything; it exists
+// so that callers which do prune their cache, like
+// github.com/containers/buildah/pkg/blobcache's Prune, can keep this cache from offering up a
+// digest whose backing file they've already deleted.
+func (fc *FileCache) Forget(blobDigest digest.Digest) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	data, err := fc.load()
+	if err != nil {
+		return
+	}
+	delete(data.UncompressedDigests, blobDigest)
+	for d, u := range data.UncompressedDigests {
+		if u == blobDigest {
+			delete(data.UncompressedDigests, d)
+		}
+	}
+	for _, byScope := range data.KnownLocations {
+		for _, byDigest := range byScope {
+			delete(byDigest, blobDigest)
+		}
+	}
+	_ = fc.save(data)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/libpod/cmd/podman/libpodruntime"
+	"github.com/containers/libpod/libpod"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	generateKubeFlags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "service, s",
+			Usage: "also generate a Kubernetes service object",
+		},
+	}
+
+	generateKubeDescription = `Generate Kubernetes Pod YAML.
+
+  Read in a pod or container and generate Kubernetes Pod YAML that can be used to run the container as a pod. With --service, a Kubernetes Service YAML is generated as well, and both objects are printed as a single YAML stream separated by "---".`
+	generateKubeCommand = cli.Command{
+		Name:                   "kube",
+		Usage:                  "Generate Kubernetes pod YAML for a container or pod",
+		Description:            generateKubeDescription,
+		Flags:                  generateKubeFlags,
+		Action:                 generateKubeCmd,
+		ArgsUsage:              "CONTAINER-OR-POD",
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+
+	generateSubCommands = []cli.Command{
+		generateKubeCommand,
+	}
+
+	generateDescription = "Generate structured data based on containers, pods or volumes"
+	generateCommand      = cli.Command{
+		Name:                   "generate",
+		Usage:                  "Generated structured data",
+		Description:            generateDescription,
+		ArgsUsage:              "",
+		Subcommands:            generateSubCommands,
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+)
+
+// generateKubeCmd takes a pod or container ID or name, converts it to Kubernetes Pod YAML, and
+// prints the result to stdout. A container identifier is wrapped in a single-container v1.Pod, the
+// way it's always been; a pod identifier produces a v1.Pod with every non-infra container.
+func generateKubeCmd(c *cli.Context) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return errors.Errorf("you must provide one container or pod ID or name")
+	}
+
+	runtime, err := libpodruntime.GetRuntime(c)
+	if err != nil {
+		return errors.Wrapf(err, "could not get runtime")
+	}
+	defer runtime.Shutdown(false)
+
+	pod, err := podOrContainerToV1Pod(runtime, args[0])
+	if err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(pod)
+	if err != nil {
+		return errors.Wrapf(err, "unable to generate kube YAML")
+	}
+	fmt.Fprintln(os.Stdout, string(out))
+
+	if c.Bool("service") {
+		svc := libpod.GenerateKubeServiceFromV1Pod(pod)
+		svcOut, err := yaml.Marshal(svc)
+		if err != nil {
+			return errors.Wrapf(err, "unable to generate kube service YAML")
+		}
+		fmt.Fprintln(os.Stdout, "---")
+		fmt.Fprintln(os.Stdout, string(svcOut))
+	}
+	return nil
+}
+
+// podOrContainerToV1Pod resolves nameOrID to either a pod or a container, preferring a pod match,
+// and generates the v1.Pod that describes it.
+func podOrContainerToV1Pod(runtime *libpod.Runtime, nameOrID string) (*v1.Pod, error) {
+	if pod, err := runtime.LookupPod(nameOrID); err == nil {
+		return pod.GenerateKube()
+	}
+
+	ctr, err := runtime.LookupContainer(nameOrID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%q is not the name or ID of a known container or pod", nameOrID)
+	}
+	return ctr.InspectForKube()
+}
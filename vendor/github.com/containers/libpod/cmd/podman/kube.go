@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/urfave/cli"
+)
+
+// kubeGenerateCommand and kubePlayCommand are generateKubeCommand and playKubeCommand (see
+// generate.go and play.go) renamed to "generate" and "play" so that "podman kube" gets
+// "kube generate"/"kube play" instead of two subcommands that'd otherwise collide on the name
+// "kube". They share the same Flags and Action as the legacy "generate kube"/"play kube" commands,
+// which are kept as-is under generateCommand/playCommand for backward compatibility.
+var (
+	kubeGenerateCommand = cli.Command{
+		Name:                   "generate",
+		Usage:                  generateKubeCommand.Usage,
+		Description:            generateKubeCommand.Description,
+		Flags:                  generateKubeCommand.Flags,
+		Action:                 generateKubeCommand.Action,
+		ArgsUsage:              generateKubeCommand.ArgsUsage,
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+	kubePlayCommand = cli.Command{
+		Name:                   "play",
+		Usage:                  playKubeCommand.Usage,
+		Description:            playKubeCommand.Description,
+		Flags:                  playKubeCommand.Flags,
+		Action:                 playKubeCommand.Action,
+		ArgsUsage:              playKubeCommand.ArgsUsage,
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+
+	// kubeSubCommands groups the Kubernetes-interop commands under "podman kube", mirroring how
+	// imageSubCommands groups image operations under "podman image".
+	kubeSubCommands = []cli.Command{
+		kubeGenerateCommand,
+		kubePlayCommand,
+	}
+
+	kubeDescription = "Manage Kubernetes YAML for pods and containers"
+	kubeCommand     = cli.Command{
+		Name:                   "kube",
+		Usage:                  "Manage Kubernetes YAML",
+		Description:            kubeDescription,
+		ArgsUsage:              "",
+		Subcommands:            kubeSubCommands,
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+)
+
+// Registering kubeCommand itself into the app's top-level Commands slice, alongside imageCommand,
+// happens in main.go, which this package snapshot doesn't include.
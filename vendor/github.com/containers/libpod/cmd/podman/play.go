@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/libpod/cmd/podman/libpodruntime"
+	"github.com/containers/libpod/libpod"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var (
+	playKubeFlags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "suppress image-pull progress output",
+		},
+	}
+
+	playKubeDescription = `Play a pod and its containers from a structured file.
+
+  Currently only Kubernetes Pod YAML, as produced by "podman generate kube", is supported.`
+	playKubeCommand = cli.Command{
+		Name:                   "kube",
+		Usage:                  "Play a pod from a Kubernetes Pod YAML file",
+		Description:            playKubeDescription,
+		Flags:                  playKubeFlags,
+		Action:                 playKubeCmd,
+		ArgsUsage:              "KUBEFILE",
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+
+	playSubCommands = []cli.Command{
+		playKubeCommand,
+	}
+
+	playDescription = "Play containers, pods or volumes based on a structured input file"
+	playCommand     = cli.Command{
+		Name:                   "play",
+		Usage:                  "Play a pod or volume",
+		Description:            playDescription,
+		ArgsUsage:              "",
+		Subcommands:            playSubCommands,
+		UseShortOptionHandling: true,
+		OnUsageError:           usageErrorHandler,
+	}
+)
+
+// playKubeCmd recreates the pod and containers described by a Kubernetes Pod YAML file.
+func playKubeCmd(c *cli.Context) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return errors.Errorf("you must provide the path to a Kubernetes YAML file")
+	}
+
+	runtime, err := libpodruntime.GetRuntime(c)
+	if err != nil {
+		return errors.Wrapf(err, "could not get runtime")
+	}
+	defer runtime.Shutdown(false)
+
+	options := libpod.PlayKubeOptions{
+		Quiet: c.Bool("quiet"),
+	}
+	report, err := runtime.PlayKube(getContext(), args[0], options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pod:\n%s\n", report.Pod)
+	if len(report.Containers) > 0 {
+		fmt.Printf("Containers:\n")
+		for _, id := range report.Containers {
+			fmt.Printf("%s\n", id)
+		}
+	}
+	for _, warning := range report.Warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	return nil
+}
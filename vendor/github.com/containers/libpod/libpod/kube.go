@@ -1,7 +1,10 @@
 package libpod
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/containers/libpod/pkg/lookup"
@@ -13,6 +16,7 @@ import (
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	v12 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // InspectForKube takes a slice of libpod containers and generates
@@ -22,11 +26,124 @@ func (c *Container) InspectForKube() (*v1.Pod, error) {
 	return simplePodWithV1Container(c)
 }
 
+// GenerateKube generates a v1.Pod description of every non-infra container in the pod, for use by
+// "podman generate kube" when the identifier given resolves to a pod rather than a single
+// container. Unlike simplePodWithV1Container, the pod's own name and labels are used (not a
+// container's), and since every container in a libpod pod shares the infra container's network
+// namespace, only the infra container's port mappings are carried into the result; they're
+// attached to the first real container, since the infra container itself is never emitted.
+func (p *Pod) GenerateKube() (*v1.Pod, error) {
+	allContainers, err := p.AllContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	var podContainers []v1.Container
+	var podVolumes []v1.Volume
+	seenVolumes := make(map[string]bool)
+	var infraPorts []v1.ContainerPort
+	for _, ctr := range allContainers {
+		if ctr.ID() == p.state.InfraContainerID {
+			if infraPorts, err = ocicniPortMappingToContainerPort(ctr.PortMappings()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		kubeContainer, volumes, err := containerToV1Container(ctr)
+		if err != nil {
+			return nil, err
+		}
+		podContainers = append(podContainers, kubeContainer)
+		// A host path bind-mounted by more than one container in the pod gets a deterministic
+		// name derived from its host path (see hostPathVolumeName), so the same mount always
+		// dedupes to a single v1.Volume here regardless of which container we saw it on first.
+		for _, volume := range volumes {
+			if !seenVolumes[volume.Name] {
+				seenVolumes[volume.Name] = true
+				podVolumes = append(podVolumes, volume)
+			}
+		}
+	}
+	if len(infraPorts) > 0 && len(podContainers) > 0 {
+		podContainers[0].Ports = infraPorts
+	}
+
+	tm := v12.TypeMeta{
+		Kind:       "Pod",
+		APIVersion: "v1",
+	}
+
+	labels := make(map[string]string)
+	labels["app"] = removeUnderscores(p.Name())
+	om := v12.ObjectMeta{
+		Name:              p.Name(),
+		Labels:            labels,
+		CreationTimestamp: v12.Now(),
+	}
+	ps := v1.PodSpec{
+		Containers: podContainers,
+		Volumes:    podVolumes,
+	}
+	pod := v1.Pod{
+		TypeMeta:   tm,
+		ObjectMeta: om,
+		Spec:       ps,
+	}
+	return &pod, nil
+}
+
+// containersToServicePorts walks a list of already-converted containers and collects a
+// v1.ServicePort for each v1.ContainerPort that has a non-zero HostPort, for use by callers
+// (namely GenerateKubeServiceFromV1Pod) that want a v1.Service to expose the ports that
+// GenerateKube/InspectForKube put on the v1.Pod.
+func containersToServicePorts(containers []v1.Container) []v1.ServicePort {
+	var ports []v1.ServicePort
+	for _, ctr := range containers {
+		for _, p := range ctr.Ports {
+			if p.HostPort == 0 {
+				continue
+			}
+			ports = append(ports, v1.ServicePort{
+				Protocol:   p.Protocol,
+				Port:       p.HostPort,
+				TargetPort: intstr.FromInt(int(p.ContainerPort)),
+			})
+		}
+	}
+	return ports
+}
+
+// GenerateKubeServiceFromV1Pod creates a v1.Service to accompany a v1.Pod previously produced by
+// GenerateKube or InspectForKube, so that "podman generate kube --service" can hand users
+// something pipeable straight into "kubectl apply -f -" alongside the pod. The service selects
+// the pod via its "app" label and exposes every host-bound container port as a NodePort.
+func GenerateKubeServiceFromV1Pod(pod *v1.Pod) v1.Service {
+	tm := v12.TypeMeta{
+		Kind:       "Service",
+		APIVersion: "v1",
+	}
+	om := v12.ObjectMeta{
+		Name:              pod.ObjectMeta.Name,
+		Labels:            pod.ObjectMeta.Labels,
+		CreationTimestamp: v12.Now(),
+	}
+	svc := v1.Service{
+		TypeMeta:   tm,
+		ObjectMeta: om,
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": pod.ObjectMeta.Labels["app"]},
+			Type:     v1.ServiceTypeNodePort,
+			Ports:    containersToServicePorts(pod.Spec.Containers),
+		},
+	}
+	return svc
+}
+
 // simplePodWithV1Container is a function used by inspect when kube yaml needs to be generated
 // for a single container.  we "insert" that container description in a pod.
 func simplePodWithV1Container(ctr *Container) (*v1.Pod, error) {
 	var containers []v1.Container
-	result, err := containerToV1Container(ctr)
+	result, volumes, err := containerToV1Container(ctr)
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +168,7 @@ func simplePodWithV1Container(ctr *Container) (*v1.Pod, error) {
 	}
 	ps := v1.PodSpec{
 		Containers: containers,
+		Volumes:    volumes,
 	}
 	p := v1.Pod{
 		TypeMeta:   tm,
@@ -60,44 +178,45 @@ func simplePodWithV1Container(ctr *Container) (*v1.Pod, error) {
 	return &p, nil
 }
 
-// containerToV1Container converts information we know about a libpod container
-// to a V1.Container specification.
-func containerToV1Container(c *Container) (v1.Container, error) {
+// containerToV1Container converts information we know about a libpod container to a V1.Container
+// specification. The second return value holds a v1.Volume for every host path the container
+// bind-mounts, so that a caller assembling a full v1.Pod can add them to Spec.Volumes (and, when
+// more than one container shares a host path, dedupe them: see hostPathVolumeName).
+func containerToV1Container(c *Container) (v1.Container, []v1.Volume, error) {
 	kubeContainer := v1.Container{}
+	var kubeVolumes []v1.Volume
 	kubeSec, err := generateKubeSecurityContext(c)
 	if err != nil {
-		return kubeContainer, err
+		return kubeContainer, kubeVolumes, err
 	}
 
 	if len(c.config.Spec.Linux.Devices) > 0 {
 		// TODO Enable when we can support devices and their names
 		devices, err := generateKubeVolumeDeviceFromLinuxDevice(c.Spec().Linux.Devices)
 		if err != nil {
-			return kubeContainer, err
+			return kubeContainer, kubeVolumes, err
 		}
 		kubeContainer.VolumeDevices = devices
-		return kubeContainer, errors.Wrapf(ErrNotImplemented, "linux devices")
+		return kubeContainer, kubeVolumes, errors.Wrapf(ErrNotImplemented, "linux devices")
 	}
 
 	if len(c.config.UserVolumes) > 0 {
-		// TODO When we until we can resolve what the volume name should be, this is disabled
-		// Volume names need to be coordinated "globally" in the kube files.
-		volumes, err := libpodMountsToKubeVolumeMounts(c)
+		volumeMounts, volumes, err := libpodMountsToKubeVolumeMounts(c)
 		if err != nil {
-			return kubeContainer, err
+			return kubeContainer, kubeVolumes, err
 		}
-		kubeContainer.VolumeMounts = volumes
-		return kubeContainer, errors.Wrapf(ErrNotImplemented, "volume names")
+		kubeContainer.VolumeMounts = volumeMounts
+		kubeVolumes = volumes
 	}
 
 	envVariables, err := libpodEnvVarsToKubeEnvVars(c.config.Spec.Process.Env)
 	if err != nil {
-		return kubeContainer, nil
+		return kubeContainer, kubeVolumes, nil
 	}
 
 	ports, err := ocicniPortMappingToContainerPort(c.PortMappings())
 	if err != nil {
-		return kubeContainer, nil
+		return kubeContainer, kubeVolumes, nil
 	}
 
 	containerCommands := c.Command()
@@ -121,7 +240,7 @@ func containerToV1Container(c *Container) (v1.Container, error) {
 	kubeContainer.StdinOnce = false
 	kubeContainer.TTY = c.config.Spec.Process.Terminal
 
-	return kubeContainer, nil
+	return kubeContainer, kubeVolumes, nil
 }
 
 // ocicniPortMappingToContainerPort takes an ocicni portmapping and converts
@@ -183,36 +302,132 @@ func libpodMaxAndMinToResourceList(c *Container) (v1.ResourceList, v1.ResourceLi
 	return maxResources, minResources
 }
 
-func generateKubeVolumeMount(hostSourcePath string, mounts []specs.Mount) (v1.VolumeMount, error) {
+// hostPathVolumeName derives a deterministic v1.Volume name for a host path that's bind-mounted
+// into a container, so that the same host path always produces the same name regardless of which
+// container mounts it or in what order. That's what lets GenerateKube dedupe a host path shared by
+// more than one container in a pod down to a single v1.Volume.
+func hostPathVolumeName(hostSourcePath string) string {
+	sum := sha256.Sum256([]byte(hostSourcePath))
+	return fmt.Sprintf("hostpath-%s", hex.EncodeToString(sum[:])[:12])
+}
+
+func generateKubeVolumeMount(hostSourcePath string, mounts []specs.Mount) (v1.VolumeMount, v1.Volume, error) {
 	vm := v1.VolumeMount{}
+	vol := v1.Volume{}
 	for _, m := range mounts {
 		if m.Source == hostSourcePath {
-			// TODO Name is not provided and is required by Kube; therefore, this is disabled earlier
-			//vm.Name =
-			vm.MountPath = m.Source
-			vm.SubPath = m.Destination
+			name := hostPathVolumeName(hostSourcePath)
+			vm.Name = name
+			vm.MountPath = m.Destination
 			if util.StringInSlice("ro", m.Options) {
 				vm.ReadOnly = true
 			}
-			return vm, nil
+			vol.Name = name
+			vol.VolumeSource = v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: hostSourcePath},
+			}
+			return vm, vol, nil
 		}
 	}
-	return vm, errors.New("unable to find mount source")
+	return vm, vol, errors.New("unable to find mount source")
 }
 
-// libpodMountsToKubeVolumeMounts converts the containers mounts to a struct kube understands
-func libpodMountsToKubeVolumeMounts(c *Container) ([]v1.VolumeMount, error) {
+// libpodMountsToKubeVolumeMounts converts the containers mounts to a struct kube understands,
+// alongside the matching v1.Volume for each one that a caller assembling a full v1.Pod needs to
+// add to Spec.Volumes.
+func libpodMountsToKubeVolumeMounts(c *Container) ([]v1.VolumeMount, []v1.Volume, error) {
 	// At this point, I dont think we can distinguish between the default
 	// volume mounts and user added ones.  For now, we pass them all.
 	var vms []v1.VolumeMount
+	var vols []v1.Volume
 	for _, hostSourcePath := range c.config.UserVolumes {
-		vm, err := generateKubeVolumeMount(hostSourcePath, c.config.Spec.Mounts)
+		vm, vol, err := generateKubeVolumeMount(hostSourcePath, c.config.Spec.Mounts)
 		if err != nil {
-			return vms, err
+			return vms, vols, err
 		}
 		vms = append(vms, vm)
+		vols = append(vols, vol)
+	}
+	return vms, vols, nil
+}
+
+// defaultCapabilities lists the capabilities a container has by default, with neither --cap-add
+// nor --cap-drop given to "podman run" -- the same default set github.com/containers/common's
+// capabilities package grants. generateKubeCapabilities diffs a container's actual bounding set
+// against this list to recover the Add/Drop capabilities a generated SecurityContext should carry.
+var defaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYS_CHROOT",
+}
+
+// generateKubeCapabilities diffs bounding, the container's effective bounding capability set,
+// against defaultCapabilities: anything missing from bounding that the default set grants becomes
+// a Drop entry, and anything in bounding beyond the default set becomes an Add entry. It returns
+// nil if bounding is exactly the default set, since that's the common case and not worth cluttering
+// the generated YAML with an empty Capabilities block.
+func generateKubeCapabilities(bounding []string) *v1.Capabilities {
+	have := make(map[string]bool, len(bounding))
+	for _, c := range bounding {
+		have[strings.ToUpper(c)] = true
+	}
+	isDefault := make(map[string]bool, len(defaultCapabilities))
+	for _, c := range defaultCapabilities {
+		isDefault[c] = true
+	}
+
+	var caps v1.Capabilities
+	for _, c := range defaultCapabilities {
+		if !have[c] {
+			caps.Drop = append(caps.Drop, v1.Capability(strings.TrimPrefix(c, "CAP_")))
+		}
+	}
+	var added []string
+	for c := range have {
+		if !isDefault[c] {
+			added = append(added, strings.TrimPrefix(c, "CAP_"))
+		}
+	}
+	sort.Strings(added)
+	for _, c := range added {
+		caps.Add = append(caps.Add, v1.Capability(c))
+	}
+
+	if len(caps.Add) == 0 && len(caps.Drop) == 0 {
+		return nil
+	}
+	return &caps
+}
+
+// generateKubeSELinuxOptions parses an OCI process SELinux label of the form
+// "user:role:type:level" (the level itself may contain colons, e.g. "s0:c1,c2", so it's captured
+// as everything after the third colon) into the equivalent v1.SELinuxOptions. It returns nil if
+// label is empty or doesn't have enough fields to make sense of.
+func generateKubeSELinuxOptions(label string) *v1.SELinuxOptions {
+	if label == "" {
+		return nil
+	}
+	parts := strings.SplitN(label, ":", 4)
+	if len(parts) < 4 {
+		return nil
+	}
+	return &v1.SELinuxOptions{
+		User:  parts[0],
+		Role:  parts[1],
+		Type:  parts[2],
+		Level: parts[3],
 	}
-	return vms, nil
 }
 
 // generateKubeSecurityContext generates a securityContext based on the existing container
@@ -221,25 +436,20 @@ func generateKubeSecurityContext(c *Container) (*v1.SecurityContext, error) {
 	ro := c.IsReadOnly()
 	allowPrivEscalation := !c.Spec().Process.NoNewPrivileges
 
-	// TODO enable use of capabilities when we can figure out how to extract cap-add|remove
-	//caps := v1.Capabilities{
-	//	//Add: c.config.Spec.Process.Capabilities
-	//}
+	var bounding []string
+	if caps := c.Spec().Process.Capabilities; caps != nil {
+		bounding = caps.Bounding
+	}
+
 	sc := v1.SecurityContext{
-		// TODO enable use of capabilities when we can figure out how to extract cap-add|remove
-		//Capabilities: &caps,
-		Privileged: &priv,
-		// TODO How do we know if selinux were passed into podman
-		//SELinuxOptions:
-		// RunAsNonRoot is an optional parameter; our first implementations should be root only; however
-		// I'm leaving this as a bread-crumb for later
-		//RunAsNonRoot:             &nonRoot,
+		Capabilities:             generateKubeCapabilities(bounding),
+		Privileged:               &priv,
+		SELinuxOptions:           generateKubeSELinuxOptions(c.Spec().Process.SelinuxLabel),
 		ReadOnlyRootFilesystem:   &ro,
 		AllowPrivilegeEscalation: &allowPrivEscalation,
 	}
 
 	if c.User() != "" {
-		// It is *possible* that
 		logrus.Debugf("Looking in container for user: %s", c.User())
 		u, err := lookup.GetUser(c.state.Mountpoint, c.User())
 		if err != nil {
@@ -247,6 +457,12 @@ func generateKubeSecurityContext(c *Container) (*v1.SecurityContext, error) {
 		}
 		user := int64(u.Uid)
 		sc.RunAsUser = &user
+		nonRoot := user != 0
+		sc.RunAsNonRoot = &nonRoot
+		if strings.Contains(c.User(), ":") {
+			group := int64(u.Gid)
+			sc.RunAsGroup = &group
+		}
 	}
 	return &sc, nil
 }
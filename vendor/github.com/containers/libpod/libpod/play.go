@@ -0,0 +1,319 @@
+package libpod
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containers/libpod/libpod/image"
+	"github.com/containers/libpod/pkg/util"
+	"github.com/cri-o/ocicni/pkg/ocicni"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// PlayKubeOptions controls the behavior of Runtime.PlayKube.
+type PlayKubeOptions struct {
+	// Quiet suppresses the image-pull progress output that would otherwise be written while
+	// missing images are fetched.
+	Quiet bool
+}
+
+// PlayKubeReport summarizes what Runtime.PlayKube created, and carries a human-readable warning
+// for every field in the input YAML that it understood but could not honor.
+type PlayKubeReport struct {
+	Pod        string
+	Containers []string
+	Warnings   []string
+}
+
+// PlayKube reads the Kubernetes YAML at path -- a v1.Pod, optionally preceded by a v1.Service in
+// the same "---"-separated stream -- and recreates it as a libpod pod: a shared infra container
+// carrying the collapsed port mappings from every v1.Container, and one libpod container per
+// entry in Spec.Containers. It is the inverse of GenerateKube/InspectForKube: those flatten a
+// libpod pod down to YAML, this builds a pod back up from it.
+func (r *Runtime) PlayKube(ctx context.Context, path string, options PlayKubeOptions) (*PlayKubeReport, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %q", path)
+	}
+
+	var kubePod *v1.Pod
+	for _, document := range splitYAMLDocuments(content) {
+		var tm v12TypeMeta
+		if err := yaml.Unmarshal(document, &tm); err != nil {
+			return nil, errors.Wrapf(err, "error parsing Kubernetes YAML in %q", path)
+		}
+		switch tm.Kind {
+		case "Pod":
+			var pod v1.Pod
+			if err := yaml.Unmarshal(document, &pod); err != nil {
+				return nil, errors.Wrapf(err, "error parsing Pod YAML in %q", path)
+			}
+			kubePod = &pod
+		case "Service":
+			// A Service has no libpod equivalent; it's accepted (since "generate kube --service"
+			// emits one right alongside the Pod) and otherwise ignored.
+			logrus.Debugf("ignoring Service object in %q: play kube has no use for it", path)
+		default:
+			logrus.Debugf("ignoring unrecognized Kubernetes object kind %q in %q", tm.Kind, path)
+		}
+	}
+	if kubePod == nil {
+		return nil, errors.Errorf("no Pod object found in %q", path)
+	}
+
+	// Resolve every pod-level volume to a host path exactly once, before any container is
+	// created, so that containers sharing an EmptyDir volume see the same directory instead of
+	// each getting its own -- EmptyDir is defined as shared across the pod's containers, and
+	// resolving it again per container (as hostPathForV1Volume would, called from inside the
+	// container loop) breaks that. emptyDirs collects the directories play kube itself created,
+	// so they can be cleaned up if a later step in this function fails.
+	volumes := make(map[string]resolvedVolume)
+	var emptyDirs []string
+	for _, v := range kubePod.Spec.Volumes {
+		hostPath, mountOptions, err := hostPathForV1Volume(v)
+		if err != nil {
+			removeEmptyDirs(emptyDirs)
+			return nil, errors.Wrapf(err, "error resolving volume %q", v.Name)
+		}
+		if v.EmptyDir != nil {
+			emptyDirs = append(emptyDirs, hostPath)
+		}
+		volumes[v.Name] = resolvedVolume{hostPath: hostPath, mountOptions: mountOptions}
+	}
+
+	podPorts, err := collectPodPortMappings(kubePod.Spec.Containers)
+	if err != nil {
+		removeEmptyDirs(emptyDirs)
+		return nil, err
+	}
+	podName := kubePod.ObjectMeta.Name
+	if podName == "" {
+		podName = "kube-pod"
+	}
+	pod, err := r.NewPod(ctx, WithPodName(podName), WithInfraContainerPorts(podPorts))
+	if err != nil {
+		removeEmptyDirs(emptyDirs)
+		return nil, errors.Wrapf(err, "error creating pod %q", podName)
+	}
+
+	report := &PlayKubeReport{Pod: pod.ID()}
+	for _, kubeContainer := range kubePod.Spec.Containers {
+		ctr, warnings, err := r.createContainerFromV1Container(ctx, pod, kubeContainer, volumes, options)
+		if err != nil {
+			if rmErr := r.RemovePod(ctx, pod, true, true); rmErr != nil {
+				logrus.Errorf("error removing pod %q after failed play kube: %v", podName, rmErr)
+			}
+			removeEmptyDirs(emptyDirs)
+			return report, errors.Wrapf(err, "error creating container %q", kubeContainer.Name)
+		}
+		report.Containers = append(report.Containers, ctr.ID())
+		report.Warnings = append(report.Warnings, warnings...)
+		if err := ctr.Start(ctx, false); err != nil {
+			if rmErr := r.RemovePod(ctx, pod, true, true); rmErr != nil {
+				logrus.Errorf("error removing pod %q after failed play kube: %v", podName, rmErr)
+			}
+			removeEmptyDirs(emptyDirs)
+			return report, errors.Wrapf(err, "error starting container %q", kubeContainer.Name)
+		}
+	}
+	return report, nil
+}
+
+// removeEmptyDirs best-effort removes the host directories PlayKube created for EmptyDir volumes.
+// It's used to clean up after an error partway through PlayKube, so a failed "play kube" doesn't
+// leave them behind.
+func removeEmptyDirs(dirs []string) {
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Debugf("error removing EmptyDir volume directory %q: %v", dir, err)
+		}
+	}
+}
+
+// v12TypeMeta mirrors just the two fields of k8s.io/apimachinery/pkg/apis/meta/v1.TypeMeta that
+// are needed to tell a Pod document apart from a Service document in a multi-document stream,
+// without pulling in the rest of that package's decoding machinery for this one check.
+type v12TypeMeta struct {
+	Kind string `json:"kind"`
+}
+
+// splitYAMLDocuments splits a "---"-separated stream of YAML documents into its individual
+// documents, the way a Kubernetes YAML file produced by "generate kube --service" is laid out.
+func splitYAMLDocuments(content []byte) [][]byte {
+	var documents [][]byte
+	for _, part := range strings.Split(string(content), "\n---") {
+		trimmed := strings.TrimSpace(part)
+		if trimmed == "" {
+			continue
+		}
+		documents = append(documents, []byte(trimmed))
+	}
+	return documents
+}
+
+// collectPodPortMappings reverses ocicniPortMappingToContainerPort: every v1.ContainerPort that
+// carries a HostPort becomes an ocicni.PortMapping on the pod's shared infra container, matching
+// how GenerateKube collapses the infra container's ports onto the first real container.
+func collectPodPortMappings(containers []v1.Container) ([]ocicni.PortMapping, error) {
+	var portMappings []ocicni.PortMapping
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			if p.HostPort == 0 {
+				continue
+			}
+			portMappings = append(portMappings, ocicni.PortMapping{
+				HostPort:      p.HostPort,
+				ContainerPort: p.ContainerPort,
+				Protocol:      strings.ToLower(string(p.Protocol)),
+				HostIP:        p.HostIP,
+			})
+		}
+	}
+	return portMappings, nil
+}
+
+// createContainerFromV1Container translates a single v1.Container (plus the pod-level volumes it
+// may reference) into a libpod container in pod. Fields this translation cannot honor yet --
+// LivenessProbe and Resources.Limits among them -- are reported back as warnings rather than
+// causing the whole pod to fail to start.
+func (r *Runtime) createContainerFromV1Container(ctx context.Context, pod *Pod, kubeContainer v1.Container, volumes map[string]resolvedVolume, options PlayKubeOptions) (*Container, []string, error) {
+	var warnings []string
+	if kubeContainer.LivenessProbe != nil {
+		warnings = append(warnings, fmt.Sprintf("container %q: LivenessProbe is not supported and was ignored", kubeContainer.Name))
+	}
+	if kubeContainer.Resources.Limits != nil {
+		warnings = append(warnings, fmt.Sprintf("container %q: Resources.Limits is not supported and was ignored", kubeContainer.Name))
+	}
+
+	var writer io.Writer
+	if !options.Quiet {
+		writer = os.Stderr
+	}
+	newImage, err := r.ImageRuntime().New(ctx, kubeContainer.Image, "", "", writer, nil, image.SigningOptions{}, false, nil)
+	if err != nil {
+		return nil, warnings, errors.Wrapf(err, "error pulling image %q", kubeContainer.Image)
+	}
+
+	spec := &specs.Spec{
+		Process: &specs.Process{
+			Args:     append(kubeContainer.Command, kubeContainer.Args...),
+			Cwd:      kubeContainer.WorkingDir,
+			Terminal: kubeContainer.TTY,
+		},
+		Linux: &specs.Linux{},
+	}
+	if spec.Process.Cwd == "" {
+		spec.Process.Cwd = "/"
+	}
+	for _, e := range kubeContainer.Env {
+		spec.Process.Env = append(spec.Process.Env, fmt.Sprintf("%s=%s", e.Name, e.Value))
+	}
+
+	ctrOptions := []CtrCreateOption{
+		WithPod(pod),
+		WithRootFSFromImage(newImage.ID(), kubeContainer.Image, false),
+	}
+	if kubeContainer.Name != "" {
+		ctrOptions = append(ctrOptions, WithName(kubeContainer.Name))
+	}
+
+	if sc := kubeContainer.SecurityContext; sc != nil {
+		if sc.Privileged != nil && *sc.Privileged {
+			spec.Linux.Resources = &specs.LinuxResources{}
+			ctrOptions = append(ctrOptions, WithPrivileged(true))
+		}
+		if sc.ReadOnlyRootFilesystem != nil {
+			spec.Root = &specs.Root{Readonly: *sc.ReadOnlyRootFilesystem}
+		}
+		if sc.RunAsUser != nil {
+			spec.Process.User = specs.User{UID: uint32(*sc.RunAsUser)}
+		}
+		if caps := sc.Capabilities; caps != nil {
+			// Start from the same default bounding set generateKubeCapabilities diffs against on
+			// the way out, then apply this container's Add/Drop on top of it, so a round-tripped
+			// "podman generate kube" | "podman play kube" ends up with the same capabilities it
+			// started with.
+			bounding := append([]string{}, defaultCapabilities...)
+			for _, c := range caps.Add {
+				capName := "CAP_" + strings.ToUpper(string(c))
+				if !util.StringInSlice(capName, bounding) {
+					bounding = append(bounding, capName)
+				}
+			}
+			for _, c := range caps.Drop {
+				capName := "CAP_" + strings.ToUpper(string(c))
+				var kept []string
+				for _, b := range bounding {
+					if b != capName {
+						kept = append(kept, b)
+					}
+				}
+				bounding = kept
+			}
+			spec.Process.Capabilities = &specs.LinuxCapabilities{Bounding: bounding}
+		}
+		if sc.SELinuxOptions != nil {
+			o := sc.SELinuxOptions
+			spec.Process.SelinuxLabel = fmt.Sprintf("%s:%s:%s:%s", o.User, o.Role, o.Type, o.Level)
+		}
+	}
+
+	for _, vm := range kubeContainer.VolumeMounts {
+		v, ok := volumes[vm.Name]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("container %q: volume mount %q refers to an unknown volume and was skipped", kubeContainer.Name, vm.Name))
+			continue
+		}
+		mountOptions := append([]string{"rbind"}, v.mountOptions...)
+		if vm.ReadOnly {
+			mountOptions = append(mountOptions, "ro")
+		}
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: vm.MountPath,
+			Type:        "bind",
+			Source:      v.hostPath,
+			Options:     mountOptions,
+		})
+	}
+
+	ctr, err := r.NewContainer(ctx, spec, ctrOptions...)
+	if err != nil {
+		return nil, warnings, err
+	}
+	return ctr, warnings, nil
+}
+
+// resolvedVolume is a pod-level v1.Volume that PlayKube has already resolved to a host path,
+// shared by every container in the pod that mounts it by name.
+type resolvedVolume struct {
+	hostPath     string
+	mountOptions []string
+}
+
+// hostPathForV1Volume resolves a pod-level v1.Volume to the host directory that should be bind
+// mounted for it. Only HostPath and EmptyDir are understood; EmptyDir is realized as a freshly
+// created temporary directory scoped to the pod, matching Kubernetes' "ephemeral, pod-lifetime"
+// semantics as closely as a single-host bind mount can. Called once per volume, from PlayKube,
+// rather than once per container, so that every container mounting the same EmptyDir volume shares
+// the same directory.
+func hostPathForV1Volume(v v1.Volume) (string, []string, error) {
+	switch {
+	case v.HostPath != nil:
+		return v.HostPath.Path, nil, nil
+	case v.EmptyDir != nil:
+		dir, err := ioutil.TempDir("", "libpod-emptydir-"+v.Name)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "error creating EmptyDir volume %q", v.Name)
+		}
+		return dir, nil, nil
+	}
+	return "", nil, errors.Errorf("volume source is neither HostPath nor EmptyDir")
+}